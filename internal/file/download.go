@@ -0,0 +1,139 @@
+package file
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// DownloadOptions 控制DownloadFile的行为
+type DownloadOptions struct {
+	// Resume为true时,如果目标路径旁已有一个同名的`.part`文件,会从其当前大小处续传,
+	// 为false时总是丢弃已有的`.part`文件并从头下载
+	Resume bool
+}
+
+// downloadTarget 是resolveDownloadTarget解析出的实际下载地址及文件元信息,
+// GetFile和DownloadFile共用同一套JSONP解包逻辑来得到它
+type downloadTarget struct {
+	url          string
+	meta         string
+	expectedSize int64
+	expectedSha1 string
+}
+
+// resolveDownloadTarget 复用元信息接口返回的jsonpUrl解包出真正的上传节点地址,
+// 同时带出服务端记录的文件大小和sha1,供续传和完整性校验使用
+func (api *Api) resolveDownloadTarget(id string) (*downloadTarget, error) {
+	result, err := api.get(fmt.Sprintf(GetFiles, id))
+	if err != nil {
+		return nil, err
+	}
+	expectedSize := gjson.Get(string(result), "data.size").Int()
+	expectedSha1 := gjson.Get(string(result), "data.sha1").String()
+	realUrlStr := gjson.Get(string(result), "data.storage.jsonpUrl").String()
+	if realUrlStr == "" {
+		return nil, errors.New("get fileUrl failed")
+	}
+	result, err = api.get(realUrlStr)
+	if err != nil {
+		return nil, err
+	}
+	realUrl := gjson.Parse(strings.Trim(string(result), "callback()"))
+	return &downloadTarget{
+		url:          realUrl.Get("url").String(),
+		meta:         realUrl.Get("meta").String(),
+		expectedSize: expectedSize,
+		expectedSha1: expectedSha1,
+	}, nil
+}
+
+//下载文件到本地,支持断点续传和下载完成后的sha1校验
+func (api *Api) DownloadFile(id string, destPath string, opts DownloadOptions) error {
+	return api.DownloadFileContext(context.Background(), id, destPath, opts)
+}
+
+// DownloadFileContext 与DownloadFile相同,但允许调用方通过ctx取消下载
+func (api *Api) DownloadFileContext(ctx context.Context, id string, destPath string, opts DownloadOptions) error {
+	target, err := api.resolveDownloadTarget(id)
+	if err != nil {
+		return err
+	}
+
+	partPath := destPath + ".part"
+	var offset int64
+	if opts.Resume {
+		if info, statErr := os.Stat(partPath); statErr == nil {
+			offset = info.Size()
+		}
+	} else if rmErr := os.Remove(partPath); rmErr != nil && !os.IsNotExist(rmErr) {
+		return rmErr
+	}
+
+	hasher := sha1.New()
+	if offset > 0 {
+		existing, openErr := os.Open(partPath)
+		if openErr != nil {
+			return openErr
+		}
+		_, copyErr := io.Copy(hasher, existing)
+		existing.Close()
+		if copyErr != nil {
+			return copyErr
+		}
+	}
+
+	sink := api.progress()
+	err = withRetry(ctx, defaultBlockRetry, func() error {
+		out, openErr := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if openErr != nil {
+			return openErr
+		}
+		defer out.Close()
+
+		request, reqErr := http.NewRequestWithContext(ctx, "POST", target.url,
+			strings.NewReader(url.Values{"meta": []string{target.meta}}.Encode()))
+		if reqErr != nil {
+			return reqErr
+		}
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if offset > 0 {
+			request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		response, doErr := api.User.HttpClient.Do(request)
+		if doErr != nil {
+			return doErr
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusPartialContent {
+			return fmt.Errorf("download failed with status %d", response.StatusCode)
+		}
+
+		written, copyErr := io.Copy(out, io.TeeReader(response.Body, hasher))
+		offset += written
+		sink.emit(ProgressEvent{Stage: StageDownloading, BytesDone: offset, BytesTotal: target.expectedSize})
+		return copyErr
+	})
+	if err != nil {
+		return err
+	}
+
+	if target.expectedSize > 0 && offset != target.expectedSize {
+		return fmt.Errorf("downloaded size %d does not match expected size %d", offset, target.expectedSize)
+	}
+	if target.expectedSha1 != "" {
+		actualSha1 := hex.EncodeToString(hasher.Sum(nil))
+		if !strings.EqualFold(actualSha1, target.expectedSha1) {
+			return fmt.Errorf("downloaded sha1 %s does not match expected sha1 %s", actualSha1, target.expectedSha1)
+		}
+	}
+	return os.Rename(partPath, destPath)
+}
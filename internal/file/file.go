@@ -1,22 +1,25 @@
 package file
 
 import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/dustin/go-humanize"
 	"github.com/tidwall/gjson"
-	"go-micloud/pkg/color"
-	"go-micloud/pkg/utils"
 	"go-micloud/pkg/zlog"
+	"golang.org/x/sync/errgroup"
 	"io"
 	"io/ioutil"
-	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"strings"
+	"sync"
 )
 
 const ChunkSize = 4194304
@@ -25,67 +28,108 @@ var (
 	SizeTooBigError = errors.New("单个文件不能大于4GB")
 )
 
-//获取文件
-func (api *Api) GetFile(id string) (io.Reader, error) {
-	result, err := api.get(fmt.Sprintf(GetFiles, id))
+//获取文件,流式返回,基于DownloadFile共用的JSONP解包逻辑。
+//建立连接的步骤复用DownloadFile同一套withRetry,避免一次瞬时网络错误就直接失败。
+//返回值是io.ReadCloser,调用方读取完毕后必须Close它以释放底层HTTP连接
+func (api *Api) GetFile(id string) (io.ReadCloser, error) {
+	target, err := api.resolveDownloadTarget(id)
 	if err != nil {
 		return nil, err
 	}
-	realUrlStr := gjson.Get(string(result), "data.storage.jsonpUrl").String()
-	if realUrlStr == "" {
-		return nil, errors.New("get fileUrl failed")
-	}
-	result, err = api.get(realUrlStr)
+	var resp *http.Response
+	err = withRetry(context.Background(), defaultBlockRetry, func() error {
+		var doErr error
+		resp, doErr = api.User.HttpClient.PostForm(target.url, url.Values{"meta": []string{target.meta}})
+		if doErr != nil {
+			return doErr
+		}
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			resp.Body.Close()
+			return fmt.Errorf("get file failed with status %d", resp.StatusCode)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	realUrl := gjson.Parse(strings.Trim(string(result), "callback()"))
-
-	resp, err := api.User.HttpClient.PostForm(
-		realUrl.Get("url").String(),
-		url.Values{"meta": []string{realUrl.Get("meta").String()}})
-	if err != nil {
-		return nil, err
+	bytesTotal := target.expectedSize
+	if bytesTotal == 0 {
+		bytesTotal = resp.ContentLength
 	}
-	return resp.Body, err
+	return &countingReader{
+		r:          resp.Body,
+		sink:       api.progress(),
+		bytesTotal: bytesTotal,
+	}, nil
 }
 
 //上传文件
 func (api *Api) UploadFile(filePath string, parentId string) (string, error) {
+	return api.UploadFileContext(context.Background(), filePath, parentId)
+}
+
+// UploadFileContext 与UploadFile相同,但允许调用方通过ctx取消上传,
+// 取消后所有正在并发上传的分片都会尽快终止
+func (api *Api) UploadFileContext(ctx context.Context, filePath string, parentId string) (string, error) {
+	return api.uploadFile(ctx, filePath, parentId, "", false)
+}
+
+// parallelChunks 返回本次上传使用的并发分片数,Api.ParallelChunks未设置时默认为4
+func (api *Api) parallelChunks() int {
+	if api.ParallelChunks > 0 {
+		return api.ParallelChunks
+	}
+	return 4
+}
+
+// uploadFile 是UploadFile/ResumeUpload/UploadFileToPath共用的实现。remoteName非空时
+// 会覆盖默认的path.Base(filePath)文件名,UploadFileToPath用它来让远程文件名匹配
+// 调用方请求的远程路径而不是本地文件名。requireSession为true时(ResumeUpload)要求
+// 本地必须已经有对应sha1的持久化会话,否则视为没有可恢复的上传而报错
+func (api *Api) uploadFile(ctx context.Context, filePath string, parentId string, remoteName string, requireSession bool) (string, error) {
 	fileInfo, err := os.Stat(filePath)
 	if err != nil {
 		return "", err
 	}
-	fileName := path.Base(filePath)
+	fileName := remoteName
+	if fileName == "" {
+		fileName = path.Base(filePath)
+	}
 
+	sink := api.progress()
 	zlog.Info(fmt.Sprintf("文件大小: %s", humanize.Bytes(uint64(fileInfo.Size()))))
 
 	if fileInfo.Size() == 0 || fileInfo.Size() >= 4*1024*1024*1024 {
 		return "", SizeTooBigError
 	}
-	zlog.Info("计算文件sha1")
+	sink.emit(ProgressEvent{Stage: StageHashing, BytesTotal: fileInfo.Size()})
 	fileSize := fileInfo.Size()
-	fileSha1 := utils.FilePathHash(filePath, "sha1")
+	//一次streaming遍历同时算出分片哈希和整文件sha1,sha1也是会话文件的key,
+	//因此ResumeUpload不需要、也不应该在调用uploadFile前单独再读一遍文件算sha1
+	blockInfos, fileSha1, err := api.getFileBlocks(fileInfo, filePath)
+	if err != nil {
+		return "", errors.New("get file blocks failed")
+	}
 
-	var blockInfos *[]BlockInfo
-	//大于4MB需要分片
-	zlog.Info("计算文件分片信息")
-	if fileSize > ChunkSize {
-		blockInfos, err = api.getFileBlocks(fileInfo, filePath)
-		if err != nil {
-			return "", errors.New("get file blocks failed")
-		}
-	} else {
-		blockInfos = &[]BlockInfo{
-			{
-				Blob: struct {
-				}{},
-				Sha1: fileSha1,
-				Md5:  utils.FilePathHash(filePath, "md5"),
-				Size: fileSize,
-			},
+	session, err := loadUploadSession(fileSha1)
+	if err != nil {
+		return "", err
+	}
+	if session == nil {
+		if requireSession {
+			return "", errors.New("没有找到可恢复的上传会话")
 		}
+		session = &UploadSession{CommitMetas: map[int]string{}}
 	}
+	session.FilePath = filePath
+	session.Sha1 = fileSha1
+	session.ParentId = parentId
+	session.FileName = fileName
+	session.FileSize = fileSize
+	if session.CommitMetas == nil {
+		session.CommitMetas = map[int]string{}
+	}
+
 	var uploadJson = UploadJson{
 		Content: UploadContent{
 			Name: fileName,
@@ -101,7 +145,7 @@ func (api *Api) UploadFile(filePath string, parentId string) (string, error) {
 	data, _ := json.Marshal(uploadJson)
 
 	//创建分片
-	zlog.Info(fmt.Sprintf("创建文件分片(%d)", len(*blockInfos)))
+	sink.emit(ProgressEvent{Stage: StageCreatingSession, ChunkCount: len(*blockInfos)})
 
 	resp, err := api.postForm(CreateFile, url.Values{
 		"data":         []string{string(data)},
@@ -124,8 +168,13 @@ func (api *Api) UploadFile(filePath string, parentId string) (string, error) {
 				Exists:   true,
 			},
 		}}
-		zlog.Info("当前文件已存在,上传完成")
-		return api.createFile(parentId, data)
+		id, err := api.createFile(parentId, data)
+		sink.emit(ProgressEvent{Stage: StageFinalizing, Err: err})
+		if err != nil {
+			return "", err
+		}
+		_ = session.remove()
+		return id, nil
 	} else {
 		//云盘不存在该文件
 		kss := gjson.Get(string(*resp), "data.storage.kss")
@@ -138,24 +187,69 @@ func (api *Api) UploadFile(filePath string, parentId string) (string, error) {
 		if apiNode == "" {
 			return "", errors.New("no available url node")
 		}
-		//上传分片
-		file, err := os.Open(filePath)
-		if err != nil {
-			return "", err
+		newUploadId := gjson.Get(string(*resp), "data.storage.uploadId").String()
+		//本地缓存的commit_meta是在旧的uploadId/fileMeta下拿到的,一旦服务端这次
+		//CreateFile返回了不同的uploadId(旧会话已经过期/被GC),就不能再信任它们了,
+		//必须让对应分片在新的uploadId下重新上传
+		if session.UploadId != "" && session.UploadId != newUploadId {
+			zlog.Logger.Warn("upload session is stale (uploadId changed), re-uploading all blocks")
+			session.CommitMetas = map[int]string{}
+		}
+		session.ApiNode = apiNode
+		session.FileMeta = fileMeta
+		session.UploadId = newUploadId
+		if err := session.save(); err != nil {
+			zlog.Logger.Warn("save upload session failed: " + err.Error())
 		}
-		var i = 0
-		var commitMetas []map[string]string
+		//并发上传分片,每个worker独立打开文件句柄并Seek到自己的偏移量,避免共享游标竞争
+		commitMetas := make([]map[string]string, len(blockMetas))
+		var (
+			mu   sync.Mutex
+			done = 0
+		)
+		sem := make(chan struct{}, api.parallelChunks())
+		group, gctx := errgroup.WithContext(ctx)
 		for k, block := range blockMetas {
-			commitMeta, err := api.uploadBlock(k, apiNode, fileMeta, file, block)
-			if err != nil {
-				return "", err
+			k, block := k, block
+			if cached, ok := session.CommitMetas[k]; ok {
+				commitMetas[k] = map[string]string{"commit_meta": cached}
+				done++
+				continue
 			}
-			commitMetas = append(commitMetas, commitMeta)
-			i++
-			fmt.Printf("\r%s", strings.Repeat(" ", 35))
-			fmt.Printf("\r" + color.Green(fmt.Sprintf("### Info: 正在上传分片(%d/%d)", i, len(*blockInfos))))
+			group.Go(func() error {
+				select {
+				case sem <- struct{}{}:
+				case <-gctx.Done():
+					return gctx.Err()
+				}
+				defer func() { <-sem }()
+
+				var commitMeta map[string]string
+				err := withRetry(gctx, defaultBlockRetry, func() error {
+					var uploadErr error
+					commitMeta, uploadErr = api.uploadBlock(gctx, k, apiNode, fileMeta, filePath, block)
+					return uploadErr
+				})
+				if err != nil {
+					return err
+				}
+
+				mu.Lock()
+				commitMetas[k] = commitMeta
+				session.CommitMetas[k] = commitMeta["commit_meta"]
+				saveErr := session.save()
+				done++
+				sink.emit(ProgressEvent{Stage: StageUploadingChunk, ChunkIndex: done, ChunkCount: len(*blockInfos)})
+				mu.Unlock()
+				if saveErr != nil {
+					zlog.Logger.Warn("save upload session failed: " + saveErr.Error())
+				}
+				return nil
+			})
+		}
+		if err := group.Wait(); err != nil {
+			return "", err
 		}
-		fmt.Printf("\n")
 		//最终完成上传
 		data := UploadJson{Content: UploadContent{
 			Name: fileName,
@@ -174,43 +268,58 @@ func (api *Api) UploadFile(filePath string, parentId string) (string, error) {
 				Exists:   false,
 			},
 		}}
-		zlog.Info("所有分片上传完毕，上传完成")
-		return api.createFile(parentId, data)
+		id, err := api.createFile(parentId, data)
+		sink.emit(ProgressEvent{Stage: StageFinalizing, Err: err})
+		if err != nil {
+			return "", err
+		}
+		_ = session.remove()
+		return id, nil
 	}
 }
 
-//获取文件分片信息
-func (api *Api) getFileBlocks(fileInfo os.FileInfo, filePath string) (*[]BlockInfo, error) {
-	num := int(math.Ceil(float64(fileInfo.Size()) / float64(ChunkSize)))
+//getFileBlocks 单次顺序读取文件:每个4MB分片的sha1/md5与整个文件的sha1
+//在同一次遍历里通过io.MultiWriter一起计算,避免大文件被读两遍,小于一个分片
+//大小的文件也走这条路径,产出单个BlockInfo
+func (api *Api) getFileBlocks(fileInfo os.FileInfo, filePath string) (*[]BlockInfo, string, error) {
 	file, err := os.OpenFile(filePath, os.O_RDONLY, os.ModePerm)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	var i int64 = 1
+	defer file.Close()
+
+	fileSha1 := sha1.New()
 	var blockInfos []BlockInfo
-	for b := make([]byte, ChunkSize); i <= int64(num); i++ {
-		offset := (i - 1) * ChunkSize
-		_, _ = file.Seek(offset, 0)
-		if len(b) > int(fileInfo.Size()-offset) {
-			b = make([]byte, fileInfo.Size()-offset)
+	remaining := fileInfo.Size()
+	buf := make([]byte, ChunkSize)
+	for remaining > 0 {
+		chunkSize := ChunkSize
+		if int64(chunkSize) > remaining {
+			chunkSize = int(remaining)
 		}
-		_, err := file.Read(b)
+		n, err := io.ReadFull(file, buf[:chunkSize])
 		if err != nil {
-			continue
+			return nil, "", err
 		}
-		blockInfo := BlockInfo{
-			Blob: struct{}{},
-			Sha1: utils.FileHash(strings.NewReader(string(b)), "sha1"),
-			Md5:  utils.FileHash(strings.NewReader(string(b)), "md5"),
-			Size: int64(len(b)),
+		chunkSha1 := sha1.New()
+		chunkMd5 := md5.New()
+		if _, err := io.MultiWriter(chunkSha1, chunkMd5, fileSha1).Write(buf[:n]); err != nil {
+			return nil, "", err
 		}
-		blockInfos = append(blockInfos, blockInfo)
+		blockInfos = append(blockInfos, BlockInfo{
+			Blob: struct{}{},
+			Sha1: hex.EncodeToString(chunkSha1.Sum(nil)),
+			Md5:  hex.EncodeToString(chunkMd5.Sum(nil)),
+			Size: int64(n),
+		})
+		remaining -= int64(n)
 	}
-	return &blockInfos, nil
+	return &blockInfos, hex.EncodeToString(fileSha1.Sum(nil)), nil
 }
 
-//上传文件分片
-func (api *Api) uploadBlock(num int, apiNode string, fileMeta string, file *os.File, block interface{}) (map[string]string, error) {
+//上传文件分片,每次调用都会打开自己的文件句柄并Seek到对应偏移量,
+//使得多个分片可以在不同goroutine中并发上传而不争抢同一个文件游标
+func (api *Api) uploadBlock(ctx context.Context, num int, apiNode string, fileMeta string, filePath string, block interface{}) (map[string]string, error) {
 	m, ok := (block).(gjson.Result)
 	if !ok {
 		return nil, errors.New("block info error")
@@ -218,37 +327,57 @@ func (api *Api) uploadBlock(num int, apiNode string, fileMeta string, file *os.F
 	//block已存在则不上传
 	if m.Get("is_existed").Int() == 1 {
 		return map[string]string{"commit_meta": m.Get("commit_meta").String()}, nil
-	} else {
-		uploadUrl := apiNode + "/upload_block_chunk?chunk_pos=0&file_meta=" + fileMeta + "&block_meta=" + m.Get("block_meta").String()
-		fileInfo, _ := file.Stat()
-		offset := int64(num * ChunkSize)
-		chunkSize := ChunkSize
-		if chunkSize > int(fileInfo.Size()-offset) {
-			chunkSize = int(fileInfo.Size() - offset)
-		}
-		fileBlock := make([]byte, chunkSize)
-		_, err := file.Seek(offset, 0)
-		_, err = file.Read(fileBlock)
-		if err != nil {
-			return nil, err
-		}
-		request, _ := http.NewRequest("POST", uploadUrl, strings.NewReader(string(fileBlock)))
-		request.Header.Set("DNT", "1")
-		request.Header.Set("Origin", "https://i.mi.com")
-		request.Header.Set("Referer", "https://i.mi.com/drive")
-		request.Header.Set("Content-Type", "application/octet-stream")
-		response, err := api.User.HttpClient.Do(request)
-		if err != nil {
-			return nil, err
-		}
-		readAll, err := ioutil.ReadAll(response.Body)
-		stat := gjson.Get(string(readAll), "stat").String()
-		if stat != "BLOCK_COMPLETED" {
-			return nil, errors.New("block not completed")
-		}
-		response.Body.Close()
-		return map[string]string{"commit_meta": gjson.Get(string(readAll), "commit_meta").String()}, nil
 	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := int64(num * ChunkSize)
+	chunkSize := ChunkSize
+	if chunkSize > int(fileInfo.Size()-offset) {
+		chunkSize = int(fileInfo.Size() - offset)
+	}
+	fileBlock := make([]byte, chunkSize)
+	if _, err := file.Seek(offset, 0); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(file, fileBlock); err != nil {
+		return nil, err
+	}
+
+	uploadUrl := apiNode + "/upload_block_chunk?chunk_pos=0&file_meta=" + fileMeta + "&block_meta=" + m.Get("block_meta").String()
+	request, err := http.NewRequestWithContext(ctx, "POST", uploadUrl, strings.NewReader(string(fileBlock)))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("DNT", "1")
+	request.Header.Set("Origin", "https://i.mi.com")
+	request.Header.Set("Referer", "https://i.mi.com/drive")
+	request.Header.Set("Content-Type", "application/octet-stream")
+	response, err := api.User.HttpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return nil, fmt.Errorf("upload block chunk failed with status %d", response.StatusCode)
+	}
+	readAll, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	stat := gjson.Get(string(readAll), "stat").String()
+	if stat != "BLOCK_COMPLETED" {
+		return nil, errors.New("block not completed")
+	}
+	return map[string]string{"commit_meta": gjson.Get(string(readAll), "commit_meta").String()}, nil
 }
 
 //最终创建文件
@@ -0,0 +1,227 @@
+package file
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rootFolderId 是小米云盘根目录的id,所有路径解析都从这里开始
+const rootFolderId = "0"
+
+const (
+	pathCacheTTL  = 30 * time.Second
+	pathCacheSize = 256
+)
+
+type pathCacheEntry struct {
+	path     string
+	id       string
+	expireAt time.Time
+}
+
+// pathCache 是一个带TTL的LRU,缓存远程路径到Xiaomi文件/目录id的映射,
+// 这样同一目录下的连续操作不需要每次都重新GetFolder列出整个目录
+type pathCache struct {
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+func newPathCache() *pathCache {
+	return &pathCache{ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *pathCache) get(p string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[p]
+	if !ok {
+		return "", false
+	}
+	entry := el.Value.(*pathCacheEntry)
+	if time.Now().After(entry.expireAt) {
+		c.ll.Remove(el)
+		delete(c.items, p)
+		return "", false
+	}
+	c.ll.MoveToFront(el)
+	return entry.id, true
+}
+
+func (c *pathCache) set(p, id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[p]; ok {
+		entry := el.Value.(*pathCacheEntry)
+		entry.id = id
+		entry.expireAt = time.Now().Add(pathCacheTTL)
+		c.ll.MoveToFront(el)
+		return
+	}
+	el := c.ll.PushFront(&pathCacheEntry{path: p, id: id, expireAt: time.Now().Add(pathCacheTTL)})
+	c.items[p] = el
+	if c.ll.Len() > pathCacheSize {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*pathCacheEntry).path)
+		}
+	}
+}
+
+func (c *pathCache) invalidate(p string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[p]; ok {
+		c.ll.Remove(el)
+		delete(c.items, p)
+	}
+}
+
+// pathCacheInitMu只保护"第一次访问时创建*pathCache"这一步,
+// 缓存本身的读写仍由pathCache自己的mu保护
+var pathCacheInitMu sync.Mutex
+
+// getPathCache 返回这个Api实例自己的路径缓存,按需惰性创建。
+// 缓存挂在Api上而不是包级变量,是因为两个登录了不同帐号的*Api同时使用时,
+// 相同的远程路径(比如都有一个"/Photos")在各自帐号下会解析到不同的id,
+// 共享缓存会让两个帐号互相读到对方的解析结果
+func (api *Api) getPathCache() *pathCache {
+	pathCacheInitMu.Lock()
+	defer pathCacheInitMu.Unlock()
+	if api.pathCache == nil {
+		api.pathCache = newPathCache()
+	}
+	return api.pathCache
+}
+
+// walkPath 从根目录开始按路径分量遍历,createMissing为true时会在目录不存在
+// 时调用CreateFolder补齐(供MkdirAll复用),否则遇到不存在的目录直接报错
+func (api *Api) walkPath(remotePath string, createMissing bool) (string, error) {
+	cache := api.getPathCache()
+	clean := path.Clean("/" + remotePath)
+	if clean == "/" {
+		return rootFolderId, nil
+	}
+	if id, ok := cache.get(clean); ok {
+		return id, nil
+	}
+	parts := strings.Split(strings.Trim(clean, "/"), "/")
+	currentId := rootFolderId
+	currentPath := ""
+	for _, name := range parts {
+		currentPath += "/" + name
+		if id, ok := cache.get(currentPath); ok {
+			currentId = id
+			continue
+		}
+		entries, err := api.GetFolder(currentId)
+		if err != nil {
+			return "", err
+		}
+		var found *File
+		for _, entry := range entries {
+			if entry.Name == name {
+				found = entry
+				break
+			}
+		}
+		switch {
+		case found != nil:
+			currentId = found.Id
+		case createMissing:
+			id, err := api.CreateFolder(name, currentId)
+			if err != nil {
+				return "", err
+			}
+			currentId = id
+		default:
+			return "", errors.New("path not found: " + currentPath)
+		}
+		cache.set(currentPath, currentId)
+	}
+	return currentId, nil
+}
+
+// resolvePath 将一个形如"/a/b/c"的远程路径解析为Xiaomi内部的文件/目录id
+func (api *Api) resolvePath(remotePath string) (string, error) {
+	return api.walkPath(remotePath, false)
+}
+
+// Stat 按远程路径查找文件/目录的元信息
+func (api *Api) Stat(remotePath string) (*File, error) {
+	clean := path.Clean("/" + remotePath)
+	if clean == "/" {
+		return nil, errors.New("cannot stat root")
+	}
+	parentId, err := api.resolvePath(path.Dir(clean))
+	if err != nil {
+		return nil, err
+	}
+	name := path.Base(clean)
+	entries, err := api.GetFolder(parentId)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.Name == name {
+			return entry, nil
+		}
+	}
+	return nil, errors.New("path not found: " + clean)
+}
+
+// ReadDir 列出远程路径下的所有文件/目录
+func (api *Api) ReadDir(remotePath string) ([]*File, error) {
+	id, err := api.resolvePath(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	return api.GetFolder(id)
+}
+
+// MkdirAll 按层级创建远程目录,已经存在的中间目录会被复用而不是报错
+func (api *Api) MkdirAll(remotePath string) (string, error) {
+	return api.walkPath(remotePath, true)
+}
+
+// Remove 删除远程路径对应的文件或目录,并让路径缓存失效
+func (api *Api) Remove(remotePath string) error {
+	clean := path.Clean("/" + remotePath)
+	parentId, err := api.resolvePath(path.Dir(clean))
+	if err != nil {
+		return err
+	}
+	name := path.Base(clean)
+	entries, err := api.GetFolder(parentId)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name == name {
+			if err := api.DeleteFile(entry.Id, entry.Type); err != nil {
+				return err
+			}
+			api.getPathCache().invalidate(clean)
+			return nil
+		}
+	}
+	return errors.New("path not found: " + clean)
+}
+
+// UploadFileToPath 按远程路径上传文件,缺失的父目录会被自动创建,上传后的远程文件名
+// 取自remotePath的最后一段而不是localPath,使得调用方无需自己管理Xiaomi内部的目录id,
+// 也不需要本地文件名和期望的远程文件名保持一致
+func (api *Api) UploadFileToPath(localPath string, remotePath string) (string, error) {
+	clean := path.Clean("/" + remotePath)
+	parentId, err := api.MkdirAll(path.Dir(clean))
+	if err != nil {
+		return "", err
+	}
+	return api.uploadFile(context.Background(), localPath, parentId, path.Base(clean), false)
+}
@@ -0,0 +1,139 @@
+package file
+
+import (
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"io"
+	"os"
+)
+
+// Stage 标识一次上传/下载进度事件所处的阶段
+type Stage int
+
+const (
+	StageHashing Stage = iota
+	StageCreatingSession
+	StageUploadingChunk
+	StageFinalizing
+	StageDownloading
+)
+
+func (s Stage) String() string {
+	switch s {
+	case StageHashing:
+		return "Hashing"
+	case StageCreatingSession:
+		return "CreatingSession"
+	case StageUploadingChunk:
+		return "UploadingChunk"
+	case StageFinalizing:
+		return "Finalizing"
+	case StageDownloading:
+		return "Downloading"
+	default:
+		return "Unknown"
+	}
+}
+
+// ProgressEvent 描述上传/下载过程中的一次进度汇报
+type ProgressEvent struct {
+	Stage      Stage
+	BytesDone  int64
+	BytesTotal int64
+	ChunkIndex int
+	ChunkCount int
+	Err        error
+}
+
+// ProgressSink 是调用方接收进度事件的方式,三个字段互不排斥,都设置时会同时收到通知
+type ProgressSink struct {
+	Callback func(ProgressEvent)
+	Channel  chan<- ProgressEvent
+	Writer   io.Writer
+}
+
+// emit 把事件分发给已注册的sink,sink为nil时什么也不做
+func (s *ProgressSink) emit(event ProgressEvent) {
+	if s == nil {
+		return
+	}
+	if s.Callback != nil {
+		s.Callback(event)
+	}
+	if s.Channel != nil {
+		select {
+		case s.Channel <- event:
+		default:
+		}
+	}
+	if s.Writer != nil {
+		renderProgress(s.Writer, event)
+	}
+}
+
+// renderProgress 是io.Writer sink的默认文本渲染,延续了历史上CLI的输出风格
+func renderProgress(w io.Writer, event ProgressEvent) {
+	switch event.Stage {
+	case StageHashing:
+		fmt.Fprint(w, "\r计算文件sha1...")
+	case StageCreatingSession:
+		fmt.Fprint(w, "\r创建文件分片...")
+	case StageUploadingChunk:
+		fmt.Fprintf(w, "\r正在上传分片(%d/%d)", event.ChunkIndex, event.ChunkCount)
+	case StageDownloading:
+		fmt.Fprintf(w, "\r正在下载(%s/%s)", humanize.Bytes(uint64(event.BytesDone)), humanize.Bytes(uint64(event.BytesTotal)))
+	case StageFinalizing:
+		if event.Err != nil {
+			fmt.Fprintf(w, "\r上传失败: %s\n", event.Err)
+		} else {
+			fmt.Fprint(w, "\r上传完成\n")
+		}
+	}
+}
+
+// defaultProgressSink 是Api.Progress未设置时使用的sink,行为与历史上直接打印到stderr一致
+func defaultProgressSink() *ProgressSink {
+	return &ProgressSink{Writer: os.Stderr}
+}
+
+// progress 返回本次调用应使用的进度sink
+func (api *Api) progress() *ProgressSink {
+	if api.Progress != nil {
+		return api.Progress
+	}
+	return defaultProgressSink()
+}
+
+// countingReader 包装一个io.Reader,每次Read都会向sink汇报已读取的字节数,
+// 用于在GetFile这类一次性返回io.Reader的调用中暴露下载进度
+type countingReader struct {
+	r          io.Reader
+	sink       *ProgressSink
+	bytesDone  int64
+	bytesTotal int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.bytesDone += int64(n)
+		c.sink.emit(ProgressEvent{
+			Stage:      StageDownloading,
+			BytesDone:  c.bytesDone,
+			BytesTotal: c.bytesTotal,
+		})
+	}
+	if err != nil && err != io.EOF {
+		c.sink.emit(ProgressEvent{Stage: StageDownloading, Err: err})
+	}
+	return n, err
+}
+
+// Close 在被包装的reader支持Close时转发调用,使GetFile返回的countingReader
+// 仍然可以被调用方当作io.Closer来释放底层HTTP连接,不支持Close的reader则什么也不做
+func (c *countingReader) Close() error {
+	if closer, ok := c.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
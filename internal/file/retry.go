@@ -0,0 +1,43 @@
+package file
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// retryConfig 描述一次指数退避重试的参数
+type retryConfig struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	factor      float64
+}
+
+// defaultBlockRetry 是分片上传失败时使用的默认重试策略:
+// 1s, 2s, 4s, 8s,最多尝试5次
+var defaultBlockRetry = retryConfig{maxAttempts: 5, baseDelay: time.Second, factor: 2}
+
+// withRetry 按指数退避+随机抖动重复执行fn,直到成功、达到最大尝试次数或ctx被取消
+func withRetry(ctx context.Context, cfg retryConfig, fn func() error) error {
+	delay := cfg.baseDelay
+	var err error
+	for attempt := 1; attempt <= cfg.maxAttempts; attempt++ {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt == cfg.maxAttempts {
+			break
+		}
+		jitter := time.Duration(rand.Int63n(int64(delay)))
+		select {
+		case <-time.After(delay + jitter/2):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay = time.Duration(float64(delay) * cfg.factor)
+	}
+	return err
+}
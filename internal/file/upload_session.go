@@ -0,0 +1,117 @@
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// UploadSession 描述一次可续传的上传任务在本地磁盘上的持久化状态,
+// 以文件的sha1作为key,进程重启后可据此跳过已提交的分片
+type UploadSession struct {
+	FilePath    string         `json:"filePath"`
+	Sha1        string         `json:"sha1"`
+	ParentId    string         `json:"parentId"`
+	FileName    string         `json:"fileName"`
+	FileSize    int64          `json:"fileSize"`
+	UploadId    string         `json:"uploadId"`
+	ApiNode     string         `json:"apiNode"`
+	FileMeta    string         `json:"fileMeta"`
+	CommitMetas map[int]string `json:"commitMetas"`
+}
+
+// uploadSessionDir 返回持久化会话文件所在目录,不存在时自动创建
+func uploadSessionDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(home, ".go-micloud", "uploads")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func uploadSessionPath(sha1 string) (string, error) {
+	dir, err := uploadSessionDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, sha1+".json"), nil
+}
+
+// loadUploadSession 读取sha1对应的上传会话,不存在时返回(nil, nil)
+func loadUploadSession(sha1 string) (*UploadSession, error) {
+	p, err := uploadSessionPath(sha1)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	session := &UploadSession{}
+	if err := json.Unmarshal(data, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// save 将当前会话状态写入磁盘,每次分片上传成功后都会调用以保证可续传。
+// 先写到同目录下的临时文件再os.Rename覆盖到目标路径,这样进程在写入中途被杀掉
+// 时留下的只会是没被rename进来的临时文件,已有的会话文件不会被截断成一份读不出来的半截JSON
+func (s *UploadSession) save() error {
+	p, err := uploadSessionPath(s.Sha1)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// remove 删除会话文件,上传成功完成或主动放弃时调用
+func (s *UploadSession) remove() error {
+	p, err := uploadSessionPath(s.Sha1)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ResumeUpload 根据本地持久化的会话恢复一次未完成的上传,
+// 已经拿到commit_meta的分片不会重新上传;但如果服务端这次CreateFile返回的uploadId
+// 与会话中记录的不同,本地缓存的commit_meta全部作废,所有分片都会重新上传。sha1由uploadFile内部通过单次streaming
+// 遍历计算,这里不单独再读一遍文件,避免重复一次全量磁盘读取
+func (api *Api) ResumeUpload(filePath string, parentId string) (string, error) {
+	return api.uploadFile(context.Background(), filePath, parentId, "", true)
+}
+
+// AbortUpload 放弃一次未完成的上传,删除本地持久化的会话记录
+func (api *Api) AbortUpload(sha1 string) error {
+	session, err := loadUploadSession(sha1)
+	if err != nil {
+		return err
+	}
+	if session == nil {
+		return errors.New("没有找到对应的上传会话")
+	}
+	return session.remove()
+}